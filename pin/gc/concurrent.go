@@ -0,0 +1,137 @@
+package gc
+
+import (
+	"context"
+	"sync"
+
+	dag "github.com/ipfs/go-ipfs/merkledag"
+
+	cid "gx/ipfs/QmV5gPoRsjN1Gid3LMdNZTyfCtP2DsvqEbMAmz82RmmiGk/go-cid"
+)
+
+// DescendantsConcurrent is like Descendants, but fans the link fetches for
+// roots and their descendants out across workers goroutines instead of
+// walking the DAG one link at a time. set.Visit is synchronized with a
+// mutex so "visit each CID once" still holds when multiple goroutines are
+// discovering the same CID through different parents.
+func DescendantsConcurrent(ctx context.Context, getLinks dag.GetLinks, set MarkSet, roots <-chan PinnedCid, workers int) error {
+	if workers < 1 {
+		workers = 1
+	}
+
+	var mu sync.Mutex
+	visit := func(c *cid.Cid) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return set.Visit(c)
+	}
+
+	// discovered carries newly-visited CIDs from the root loop and from
+	// the workers themselves, which are its only producers. queue is
+	// what the workers actually range over. These have to be two
+	// separate channels: if a worker enqueued a child directly onto the
+	// same bounded queue it drains, then every worker blocking on that
+	// send at once (a high-fan-out node) would leave nothing left to
+	// drain the queue, deadlocking the whole walk. The dispatcher
+	// goroutine below is the only sender on queue, so it can always make
+	// room by draining discovered into an unbounded buffer first.
+	discovered := make(chan *cid.Cid)
+	queue := make(chan *cid.Cid)
+
+	// pending tracks CIDs that have been visited but not yet fully
+	// processed (discovered, queued, or having their links fetched), so
+	// we know when there is no more work left and discovered can be
+	// closed.
+	var pending sync.WaitGroup
+
+	var errOnce sync.Once
+	var walkErr error
+	setErr := func(err error) {
+		errOnce.Do(func() { walkErr = err })
+	}
+
+	enqueue := func(c *cid.Cid) {
+		pending.Add(1)
+		select {
+		case discovered <- c:
+		case <-ctx.Done():
+			pending.Done()
+		}
+	}
+
+	dispatchDone := make(chan struct{})
+	go func() {
+		defer close(dispatchDone)
+		defer close(queue)
+
+		var buf []*cid.Cid
+		for {
+			if len(buf) == 0 {
+				c, ok := <-discovered
+				if !ok {
+					return
+				}
+				buf = append(buf, c)
+				continue
+			}
+
+			select {
+			case c, ok := <-discovered:
+				if !ok {
+					for _, c := range buf {
+						select {
+						case queue <- c:
+						case <-ctx.Done():
+							return
+						}
+					}
+					return
+				}
+				buf = append(buf, c)
+			case queue <- buf[0]:
+				buf = buf[1:]
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for c := range queue {
+				links, err := getLinks(ctx, c)
+				if err != nil {
+					setErr(err)
+					pending.Done()
+					continue
+				}
+				for _, l := range links {
+					if visit(l.Cid) {
+						enqueue(l.Cid)
+					}
+				}
+				pending.Done()
+			}
+		}()
+	}
+
+	for pc := range roots {
+		if pc.Err != nil {
+			setErr(pc.Err)
+			continue
+		}
+		if visit(pc.C) {
+			enqueue(pc.C)
+		}
+	}
+
+	pending.Wait()
+	close(discovered)
+	<-dispatchDone
+	wg.Wait()
+
+	return walkErr
+}
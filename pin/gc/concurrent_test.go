@@ -0,0 +1,135 @@
+package gc
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	mh "gx/ipfs/QmU9a9NV9RdPNwZQDYd5uKsm6N6WjCi1bYpSKyZ3hUAcCx/go-multihash"
+	cid "gx/ipfs/QmV5gPoRsjN1Gid3LMdNZTyfCtP2DsvqEbMAmz82RmmiGk/go-cid"
+	node "gx/ipfs/QmYDscK7dmdo2GZ9aumS8s5auUUAH5mR1jvj5pYhWusfK7/go-ipld-node"
+)
+
+func testCid(t *testing.T, name string) *cid.Cid {
+	t.Helper()
+	h, err := mh.Sum([]byte(name), mh.SHA2_256, -1)
+	if err != nil {
+		t.Fatalf("hashing %q: %s", name, err)
+	}
+	return cid.NewCidV1(cid.Raw, h)
+}
+
+// fakeGetLinks serves a fixed adjacency list and counts how many times
+// each CID's links were fetched, so tests can assert a shared descendant
+// is only walked once.
+type fakeGetLinks struct {
+	links map[string][]*cid.Cid
+
+	mu    sync.Mutex
+	calls map[string]int
+}
+
+func (g *fakeGetLinks) get(ctx context.Context, c *cid.Cid) ([]*node.Link, error) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]int)
+	}
+	g.calls[c.KeyString()]++
+	g.mu.Unlock()
+
+	var out []*node.Link
+	for _, child := range g.links[c.KeyString()] {
+		out = append(out, &node.Link{Cid: child})
+	}
+	return out, nil
+}
+
+func (g *fakeGetLinks) callCount(c *cid.Cid) int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.calls[c.KeyString()]
+}
+
+func rootsChan(cids ...*cid.Cid) <-chan PinnedCid {
+	out := make(chan PinnedCid, len(cids))
+	for _, c := range cids {
+		out <- PinnedCid{C: c}
+	}
+	close(out)
+	return out
+}
+
+func runWithTimeout(t *testing.T, d time.Duration, f func() error) error {
+	t.Helper()
+	done := make(chan error, 1)
+	go func() { done <- f() }()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(d):
+		t.Fatalf("timed out after %s; DescendantsConcurrent likely deadlocked", d)
+		return nil
+	}
+}
+
+// TestDescendantsConcurrentVisitOnce checks that a descendant reachable
+// from two different roots only has its links fetched once, matching
+// Descendants' (serial) dedup behavior.
+func TestDescendantsConcurrentVisitOnce(t *testing.T) {
+	shared := testCid(t, "shared")
+	rootA := testCid(t, "rootA")
+	rootB := testCid(t, "rootB")
+
+	g := &fakeGetLinks{links: map[string][]*cid.Cid{
+		rootA.KeyString(): {shared},
+		rootB.KeyString(): {shared},
+	}}
+
+	set := &memMarkSet{seen: make(map[string]struct{})}
+	ctx := context.Background()
+
+	err := runWithTimeout(t, 5*time.Second, func() error {
+		return DescendantsConcurrent(ctx, g.get, set, rootsChan(rootA, rootB), 4)
+	})
+	if err != nil {
+		t.Fatalf("DescendantsConcurrent: %s", err)
+	}
+
+	if n := g.callCount(shared); n != 1 {
+		t.Errorf("expected shared descendant's links to be fetched once, got %d", n)
+	}
+	if !set.Has(shared) || !set.Has(rootA) || !set.Has(rootB) {
+		t.Errorf("expected roots and shared descendant to be marked")
+	}
+}
+
+// TestDescendantsConcurrentHighFanOut walks a single node with far more
+// children than the worker pool's old bounded queue held, to catch a
+// regression of the deadlock where workers blocked enqueuing children
+// onto the same bounded queue they were the only consumers of.
+func TestDescendantsConcurrentHighFanOut(t *testing.T) {
+	const workers = 2
+	const fanOut = 500 // several times workers*4, the old queue capacity
+
+	root := testCid(t, "fanout-root")
+	links := make(map[string][]*cid.Cid, fanOut)
+	var children []*cid.Cid
+	for i := 0; i < fanOut; i++ {
+		c := testCid(t, "fanout-child-"+strconv.Itoa(i))
+		children = append(children, c)
+	}
+	links[root.KeyString()] = children
+
+	g := &fakeGetLinks{links: links}
+	set := &memMarkSet{seen: make(map[string]struct{})}
+	ctx := context.Background()
+
+	err := runWithTimeout(t, 10*time.Second, func() error {
+		return DescendantsConcurrent(ctx, g.get, set, rootsChan(root), workers)
+	})
+	if err != nil {
+		t.Fatalf("DescendantsConcurrent: %s", err)
+	}
+}
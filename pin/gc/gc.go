@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"sync/atomic"
 
 	bstore "github.com/ipfs/go-ipfs/blocks/blockstore"
 	dag "github.com/ipfs/go-ipfs/merkledag"
@@ -16,39 +17,176 @@ import (
 
 var log = logging.Logger("gc")
 
-// GC performs a mark and sweep garbage collection of the blocks in the blockstore
+// PinnedCid is a single key streamed from a Pinner's pin set, or an error
+// encountered while enumerating it. Streaming the pin set as these arrive
+// lets GC start marking roots without first materializing the whole set
+// in memory.
+type PinnedCid struct {
+	C   *cid.Cid
+	Err error
+}
+
+// StreamingPinner is implemented by a pin.Pinner that can stream its pin
+// sets instead of returning them as fully materialized slices. Pinners
+// backed by very large pin sets should implement this so GC's mark phase
+// stays memory-bounded; GC falls back to the slice-based pin.Pinner
+// methods for pinners that don't.
+type StreamingPinner interface {
+	RecursiveKeysChan(ctx context.Context) <-chan PinnedCid
+	DirectKeysChan(ctx context.Context) <-chan PinnedCid
+	InternalPinsChan(ctx context.Context) <-chan PinnedCid
+}
+
+// pinsChan wraps an already materialized slice of keys as a PinnedCid
+// channel, so callers can treat streaming and non-streaming pinners
+// uniformly.
+func pinsChan(cids []*cid.Cid) <-chan PinnedCid {
+	out := make(chan PinnedCid, len(cids))
+	for _, c := range cids {
+		out <- PinnedCid{C: c}
+	}
+	close(out)
+	return out
+}
+
+func recursiveKeysChan(pn pin.Pinner) <-chan PinnedCid {
+	if sp, ok := pn.(StreamingPinner); ok {
+		return sp.RecursiveKeysChan(context.Background())
+	}
+	return pinsChan(pn.RecursiveKeys())
+}
+
+func directKeysChan(pn pin.Pinner) <-chan PinnedCid {
+	if sp, ok := pn.(StreamingPinner); ok {
+		return sp.DirectKeysChan(context.Background())
+	}
+	return pinsChan(pn.DirectKeys())
+}
+
+func internalPinsChan(pn pin.Pinner) <-chan PinnedCid {
+	if sp, ok := pn.(StreamingPinner); ok {
+		return sp.InternalPinsChan(context.Background())
+	}
+	return pinsChan(pn.InternalPins())
+}
+
+// Result represents the outcome of a single step of a GC run: exactly one
+// of Removed or Error is set. Removed carries a key that was deleted from
+// the blockstore; Error carries a (possibly non-fatal) error encountered
+// while marking or sweeping.
+type Result struct {
+	Removed *cid.Cid
+	Error   error
+}
+
+// emit sends r on out, but gives up as soon as ctx is done instead of
+// blocking forever on a caller that has stopped reading or cancelled the
+// GC run.
+func emit(ctx context.Context, out chan<- Result, r Result) bool {
+	select {
+	case out <- r:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// GCOptions tunes how GCWithOptions builds and consults the marked set.
+// The zero value behaves like DefaultGCOptions: a nil MarkSetBuilder falls
+// back to DefaultMarkSetBuilder and a Concurrency below 2 walks serially.
+type GCOptions struct {
+	// MarkSetBuilder picks the marked-set implementation, e.g. a
+	// disk-backed one for very large repos.
+	MarkSetBuilder MarkSetBuilder
+
+	// Concurrency is the number of goroutines used to fetch links
+	// during the mark phase. 1 walks the DAG serially, matching GC's
+	// original behavior.
+	Concurrency int
+
+	// EstimatedPins hints how many pins the marked set should be sized
+	// for. 0 lets ColoredSet fall back to pn's PinCounter implementation
+	// (if any), then to the builder's own default sizing.
+	EstimatedPins int
+}
+
+// DefaultGCOptions is the GCOptions GC runs with: an in-memory MarkSet
+// and a serial, single-goroutine mark phase.
+var DefaultGCOptions = GCOptions{
+	MarkSetBuilder: DefaultMarkSetBuilder,
+	Concurrency:    1,
+}
+
+// GC runs GCWithOptions with DefaultGCOptions, which matches GC's
+// historical behavior.
+func GC(ctx context.Context, bs bstore.GCBlockstore, ls dag.LinkService, pn pin.Pinner, rootProviders []RootProvider) <-chan Result {
+	return GCWithOptions(ctx, bs, ls, pn, rootProviders, DefaultGCOptions)
+}
+
+// GCWithOptions performs a mark and sweep garbage collection of the blocks in the blockstore
 // first, it creates a 'marked' set and adds to it the following:
 // - all recursively pinned blocks, plus all of their descendants (recursively)
-// - bestEffortRoots, plus all of its descendants (recursively)
+// - every root supplied by rootProviders, plus all of its descendants (recursively)
 // - all directly pinned blocks
 // - all blocks utilized internally by the pinner
 //
 // The routine then iterates over every block in the blockstore and
 // deletes any block that is not found in the marked set.
 //
-func GC(ctx context.Context, bs bstore.GCBlockstore, ls dag.LinkService, pn pin.Pinner, bestEffortRoots []*cid.Cid) (<-chan *cid.Cid, <-chan error) {
+// opts controls how the marked set is stored and how many goroutines the
+// mark phase uses to fetch links; see GCOptions.
+func GCWithOptions(ctx context.Context, bs bstore.GCBlockstore, ls dag.LinkService, pn pin.Pinner, rootProviders []RootProvider, opts GCOptions) <-chan Result {
 	unlocker := bs.GCLock()
 	ls = ls.GetOfflineLinkService()
 
-	output := make(chan *cid.Cid)
-	errOutput := make(chan error)
+	output := make(chan Result)
 
 	go func() {
-		defer close(errOutput)
 		defer close(output)
 		defer unlocker.Unlock()
 
-		gcs, err := ColoredSet(ctx, pn, ls, bestEffortRoots, errOutput)
-		if err != nil {
-			errOutput <- err
-			return
+		// Kick off the (potentially slow) datastore key enumeration
+		// concurrently with the mark phase below, instead of waiting
+		// for every pin to be walked first. Blocks are only ever
+		// deleted once the mark set returned by ColoredSet is
+		// complete, so this does not weaken the GCLock guarantee that
+		// no block absent from the completed mark set is removed.
+		type markResult struct {
+			gcs MarkSet
+			err error
 		}
+		markDone := make(chan markResult, 1)
+		go func() {
+			bestEffortRoots := resolveRootProviders(ctx, rootProviders, output)
+			gcs, err := ColoredSet(ctx, pn, ls, bestEffortRoots, output, opts.MarkSetBuilder, opts.Concurrency, opts.EstimatedPins)
+			markDone <- markResult{gcs, err}
+		}()
 
-		keychan, err := bs.AllKeysChan(ctx)
-		if err != nil {
-			errOutput <- err
+		keychan, keysErr := bs.AllKeysChan(ctx)
+
+		// Always wait for the mark goroutine before returning, even on
+		// an AllKeysChan error: it's still running and still emitting
+		// on output via resolveRootProviders/ColoredSet, and this
+		// goroutine's deferred close(output)/unlocker.Unlock() would
+		// otherwise race its sends (a send on a closed channel panics)
+		// and drop the GCLock while it's still walking.
+		mr := <-markDone
+		if mr.gcs != nil {
+			// ColoredSet still returns the mark set it built even when
+			// it's reporting an error, so its store (e.g. a bloom
+			// markset's on-disk backing) is always released.
+			defer mr.gcs.Close()
+		}
+
+		if keysErr != nil {
+			emit(ctx, output, Result{Error: keysErr})
+			return
+		}
+		if mr.err != nil {
+			emit(ctx, output, Result{Error: mr.err})
 			return
 		}
+		gcs := mr.gcs
 
 		errors := false
 
@@ -56,19 +194,27 @@ func GC(ctx context.Context, bs bstore.GCBlockstore, ls dag.LinkService, pn pin.
 			select {
 			case k, ok := <-keychan:
 				if !ok {
+					if errors {
+						emit(ctx, output, Result{Error: CouldNotDeleteSomeBlocksError})
+					}
 					return
 				}
+				// gcs is keyed by multihash (k.Hash()), not by the full
+				// CID, so a block pinned under one CID version/codec is
+				// still recognized as marked when the blockstore's own
+				// enumeration surfaces it under another.
 				if !gcs.Has(k) {
 					err := bs.DeleteBlock(k)
 					if err != nil {
 						errors = true
-						errOutput <- &CoultNotDeleteBlockError{k, err}
-						//log.Debugf("Error removing key from blockstore: %s", err)
+						if !emit(ctx, output, Result{Error: &CoultNotDeleteBlockError{k, err}}) {
+							//log.Debugf("Error removing key from blockstore: %s", err)
+							return
+						}
 						// continue as error is non-fatal
+						continue
 					}
-					select {
-					case output <- k:
-					case <-ctx.Done():
+					if !emit(ctx, output, Result{Removed: k}) {
 						return
 					}
 				}
@@ -76,21 +222,71 @@ func GC(ctx context.Context, bs bstore.GCBlockstore, ls dag.LinkService, pn pin.
 				return
 			}
 		}
-		if errors {
-			errOutput <- CouldNotDeleteSomeBlocksError
+	}()
+
+	return output
+}
+
+// GCChans is a compatibility shim for callers still built against the old
+// twin output/error channels. It splits the unified Result stream from GC
+// back into those two channels; new code should consume GC's Result
+// stream directly instead.
+func GCChans(ctx context.Context, bs bstore.GCBlockstore, ls dag.LinkService, pn pin.Pinner, bestEffortRoots []*cid.Cid) (<-chan *cid.Cid, <-chan error) {
+	res := GC(ctx, bs, ls, pn, []RootProvider{StaticRoots(bestEffortRoots)})
+
+	output := make(chan *cid.Cid)
+	errOutput := make(chan error)
+
+	go func() {
+		defer close(output)
+		defer close(errOutput)
+
+		for r := range res {
+			if r.Error != nil {
+				select {
+				case errOutput <- r.Error:
+				case <-ctx.Done():
+					return
+				}
+				continue
+			}
+			select {
+			case output <- r.Removed:
+			case <-ctx.Done():
+				return
+			}
 		}
 	}()
 
 	return output, errOutput
 }
 
-func Descendants(ctx context.Context, getLinks dag.GetLinks, set *cid.Set, roots []*cid.Cid) error {
-	for _, c := range roots {
-		set.Add(c)
+// walkPinnedDAG walks root and all of its descendants (fetched via
+// getLinks), calling visit on each one. The root is always visited;
+// dag.EnumerateChildren applies visit's own dedup logic to descendants,
+// so a CID already visited through another root is not walked twice.
+// Descendants uses this directly for marking. Verify's walk
+// (verifyPinnedDAG) does not call this helper: it memoizes per CID
+// whether a block's whole subtree verified clean, which this helper's
+// flat visit callback has no way to report, so it walks with its own
+// recursive closure instead, against the same offline link service.
+func walkPinnedDAG(ctx context.Context, getLinks dag.GetLinks, root *cid.Cid, visit func(c *cid.Cid) bool) error {
+	visit(root)
+	return dag.EnumerateChildren(ctx, getLinks, root, visit)
+}
 
-		// EnumerateChildren recursively walks the dag and adds the keys to the given set
-		err := dag.EnumerateChildren(ctx, getLinks, c, set.Visit)
-		if err != nil {
+// Descendants consumes roots as they arrive on the given channel, adding
+// each one plus all of its descendants (fetched via getLinks) to set. It
+// does not wait for the caller to finish enumerating roots before it
+// starts walking them, so the mark phase can overlap with a pinner that is
+// still streaming its pin set.
+func Descendants(ctx context.Context, getLinks dag.GetLinks, set MarkSet, roots <-chan PinnedCid) error {
+	for pc := range roots {
+		if pc.Err != nil {
+			return pc.Err
+		}
+
+		if err := walkPinnedDAG(ctx, getLinks, pc.C, set.Visit); err != nil {
 			return err
 		}
 	}
@@ -98,54 +294,114 @@ func Descendants(ctx context.Context, getLinks dag.GetLinks, set *cid.Set, roots
 	return nil
 }
 
-func ColoredSet(ctx context.Context, pn pin.Pinner, ls dag.LinkService, bestEffortRoots []*cid.Cid, errOutput chan<- error) (*cid.Set, error) {
-	// KeySet currently implemented in memory, in the future, may be bloom filter or
-	// disk backed to conserve memory.
-	errors := false
-	gcs := cid.NewSet()
+// walkDescendants dispatches to Descendants or DescendantsConcurrent based
+// on concurrency, so ColoredSet's three traversals all honor the same
+// tuning knob.
+func walkDescendants(ctx context.Context, getLinks dag.GetLinks, set MarkSet, roots <-chan PinnedCid, concurrency int) error {
+	if concurrency <= 1 {
+		return Descendants(ctx, getLinks, set, roots)
+	}
+	return DescendantsConcurrent(ctx, getLinks, set, roots, concurrency)
+}
+
+// PinCounter is implemented by a pin.Pinner that can report approximately
+// how many pins it holds without materializing the pin set. ColoredSet
+// consults it, when estimatedPins isn't supplied directly, to size the
+// marked set up front instead of letting the builder guess.
+type PinCounter interface {
+	PinCount(ctx context.Context) (int, error)
+}
+
+func ColoredSet(ctx context.Context, pn pin.Pinner, ls dag.LinkService, bestEffortRoots []*cid.Cid, out chan<- Result, builder MarkSetBuilder, concurrency int, estimatedPins int) (MarkSet, error) {
+	if builder == nil {
+		builder = DefaultMarkSetBuilder
+	}
+	if estimatedPins <= 0 {
+		if pc, ok := pn.(PinCounter); ok {
+			if n, err := pc.PinCount(ctx); err == nil {
+				estimatedPins = n
+			}
+		}
+	}
+	// builder.New is free to pick its own default sizing when
+	// estimatedPins is still 0 here, e.g. for a pinner that doesn't
+	// implement PinCounter and no explicit GCOptions.EstimatedPins.
+	gcs, err := builder.New(estimatedPins)
+	if err != nil {
+		return nil, err
+	}
+
+	// getLinks and bestEffortGetLinks below are invoked concurrently by
+	// walkDescendants when concurrency > 1, so the flag they set on
+	// failure has to be synchronized too; sawError does that with a
+	// single atomic flag rather than a mutex, since it's only ever set,
+	// never cleared.
+	var errorFlag int32
+	sawError := func() bool { return atomic.LoadInt32(&errorFlag) != 0 }
+	setError := func() { atomic.StoreInt32(&errorFlag, 1) }
+
 	getLinks := func(ctx context.Context, cid *cid.Cid) ([]*node.Link, error) {
 		links, err := ls.GetLinks(ctx, cid)
 		if err != nil {
-			errors = true
-			errOutput <- &CoultNotFetchLinksError{cid, err}
+			setError()
+			emit(ctx, out, Result{Error: &CoultNotFetchLinksError{cid, err}})
 		}
 		return links, nil
 	}
-	err := Descendants(ctx, getLinks, gcs, pn.RecursiveKeys())
+	err = walkDescendants(ctx, getLinks, gcs, recursiveKeysChan(pn), concurrency)
 	if err != nil {
-		errors = true
-		errOutput <- err
+		setError()
+		emit(ctx, out, Result{Error: err})
 	}
 
 	bestEffortGetLinks := func(ctx context.Context, cid *cid.Cid) ([]*node.Link, error) {
 		links, err := ls.GetLinks(ctx, cid)
 		if err != nil && err != dag.ErrNotFound {
-			errors = true
-			errOutput <- &CoultNotFetchLinksError{cid, err}
+			setError()
+			emit(ctx, out, Result{Error: &CoultNotFetchLinksError{cid, err}})
 		}
 		return links, nil
 	}
-	err = Descendants(ctx, bestEffortGetLinks, gcs, bestEffortRoots)
+	err = walkDescendants(ctx, bestEffortGetLinks, gcs, pinsChan(bestEffortRoots), concurrency)
 	if err != nil {
-		errors = true
-		errOutput <- err
+		setError()
+		emit(ctx, out, Result{Error: err})
 	}
 
-	for _, k := range pn.DirectKeys() {
-		gcs.Add(k)
+	for pc := range directKeysChan(pn) {
+		if pc.Err != nil {
+			setError()
+			emit(ctx, out, Result{Error: pc.Err})
+			continue
+		}
+		if err := gcs.Add(pc.C); err != nil {
+			setError()
+			emit(ctx, out, Result{Error: err})
+		}
 	}
 
-	err = Descendants(ctx, getLinks, gcs, pn.InternalPins())
+	err = walkDescendants(ctx, getLinks, gcs, internalPinsChan(pn), concurrency)
 	if err != nil {
-		errors = true
-		errOutput <- err
+		setError()
+		emit(ctx, out, Result{Error: err})
+	}
+
+	if err := gcs.Err(); err != nil {
+		// The mark set itself failed to persist one or more marks, so
+		// even though the walks above completed, gcs may be missing
+		// blocks it believes are unmarked. Treat that the same as a
+		// failed walk: abort rather than sweep on an incomplete set.
+		setError()
+		emit(ctx, out, Result{Error: err})
 	}
 
-	if errors {
-		return nil, CoundNotFetchAllLinksError
-	} else {
-		return gcs, nil
+	if sawError() {
+		// Return gcs along with the error rather than discarding it: the
+		// caller still needs to Close it to release whatever storage it
+		// opened, even though the mark phase didn't complete cleanly.
+		return gcs, CoundNotFetchAllLinksError
 	}
+	return gcs, nil
 }
 
 var CoundNotFetchAllLinksError = errors.New("could not retrieve some links, aborting")
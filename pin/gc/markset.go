@@ -0,0 +1,192 @@
+package gc
+
+import (
+	"encoding/base32"
+	"io"
+	"sync"
+
+	bloom "gx/ipfs/QmPTPRAcFqN3ZA4WtQQYKDZXjg1aRtpg5k5qVA2aqsrWfW/bloom"
+	cid "gx/ipfs/QmV5gPoRsjN1Gid3LMdNZTyfCtP2DsvqEbMAmz82RmmiGk/go-cid"
+	ds "gx/ipfs/QmZ6nzCLwGLVfRzYLpD7pW6UNuBDKEcA2imJtVpiEX6mSq/go-datastore"
+)
+
+// MarkSet is the marked set built during GC's mark phase and consulted
+// during sweep. It is keyed by multihash, not by the full CID: a block
+// reachable via one CID (say CIDv0/dag-pb) marks the same underlying
+// block regardless of which CID version or codec a pin or a link
+// happens to reference it by. It is the interface ColoredSet and GC use
+// in place of a bare *cid.Set, so operators can also trade memory for IO
+// by picking a disk-backed implementation on very large repos.
+type MarkSet interface {
+	Add(c *cid.Cid) error
+	Has(c *cid.Cid) bool
+	// Visit adds c to the set and reports whether it was newly added,
+	// matching the semantics dag.EnumerateChildren expects of a visit
+	// function: returning false stops that branch from being walked
+	// again.
+	Visit(c *cid.Cid) bool
+	// Err returns the first error encountered while persisting a mark,
+	// if any. A MarkSet backed by fallible storage must fail closed:
+	// once persisting a mark has failed, Has must stop trusting "not
+	// found" results (since a block it believes is unmarked may in
+	// fact be marked) and Err must report why, so the mark phase can be
+	// aborted instead of sweeping on an incomplete set.
+	Err() error
+	Close() error
+}
+
+// MarkSetBuilder constructs a MarkSet sized from an estimated pin count
+// (0 if unknown). GC and ColoredSet accept a MarkSetBuilder so the mark
+// set's storage strategy can be chosen independently of the marking
+// logic itself.
+type MarkSetBuilder interface {
+	New(estimatedPins int) (MarkSet, error)
+}
+
+// memMarkSet is a MarkSet backed by an in-memory map of multihashes: the
+// GC's behavior before MarkSetBuilder was introduced, except keyed by
+// multihash instead of by full CID. Its storage can't fail, so Add never
+// errors and Err is always nil.
+type memMarkSet struct {
+	seen map[string]struct{}
+}
+
+func (s *memMarkSet) Add(c *cid.Cid) error {
+	s.seen[string(c.Hash())] = struct{}{}
+	return nil
+}
+
+func (s *memMarkSet) Has(c *cid.Cid) bool {
+	_, ok := s.seen[string(c.Hash())]
+	return ok
+}
+
+func (s *memMarkSet) Visit(c *cid.Cid) bool {
+	k := string(c.Hash())
+	if _, ok := s.seen[k]; ok {
+		return false
+	}
+	s.seen[k] = struct{}{}
+	return true
+}
+
+func (s *memMarkSet) Err() error { return nil }
+
+func (s *memMarkSet) Close() error { return nil }
+
+type memMarkSetBuilder struct{}
+
+func (memMarkSetBuilder) New(estimatedPins int) (MarkSet, error) {
+	return &memMarkSet{seen: make(map[string]struct{}, estimatedPins)}, nil
+}
+
+// DefaultMarkSetBuilder is the MarkSetBuilder GC and ColoredSet fall back
+// to when the caller doesn't supply one.
+var DefaultMarkSetBuilder MarkSetBuilder = memMarkSetBuilder{}
+
+// BloomMarkSetBuilder builds MarkSets backed by a bloom filter sized from
+// the estimated pin count and FalsePositiveRate, plus an exact on-disk set
+// in Store that is consulted on bloom hits. A bloom hit that Store can't
+// confirm (because Store itself failed) is treated as marked rather than
+// unmarked: see bloomMarkSet's Add/Has for why failing open here would be
+// a correctness bug, not just an efficiency loss.
+type BloomMarkSetBuilder struct {
+	Store             ds.Datastore
+	FalsePositiveRate float64
+}
+
+func (b BloomMarkSetBuilder) New(estimatedPins int) (MarkSet, error) {
+	if estimatedPins <= 0 {
+		// No estimate from the caller; size for a repo with a modest
+		// pin count rather than refuse to build the filter.
+		estimatedPins = 1 << 16
+	}
+	rate := b.FalsePositiveRate
+	if rate <= 0 {
+		rate = 0.01
+	}
+	return &bloomMarkSet{
+		filter: bloom.NewWithEstimates(uint(estimatedPins), rate),
+		store:  b.Store,
+	}, nil
+}
+
+type bloomMarkSet struct {
+	filter *bloom.BloomFilter
+	store  ds.Datastore
+
+	mu  sync.Mutex
+	err error // first error seen persisting or reading a mark, if any
+}
+
+// markSetKey keys the bloom filter and the on-disk exact set by
+// multihash rather than by the full CID, so a block marked via one CID
+// version/codec is recognized as marked when swept under another.
+// The multihash is base32-encoded first, matching the rest of go-ipfs
+// (see dshelp): ds.NewKey path-cleans its input, which would silently
+// mangle raw binary multihash bytes instead of just storing them.
+func markSetKey(c *cid.Cid) ds.Key {
+	return ds.NewKey(base32.RawStdEncoding.EncodeToString(c.Hash()))
+}
+
+func (s *bloomMarkSet) setErr(err error) {
+	s.mu.Lock()
+	if s.err == nil {
+		s.err = err
+	}
+	s.mu.Unlock()
+}
+
+func (s *bloomMarkSet) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+func (s *bloomMarkSet) Add(c *cid.Cid) error {
+	s.filter.Add(c.Hash())
+	if err := s.store.Put(markSetKey(c), struct{}{}); err != nil {
+		// This mark was never persisted, so Has can no longer trust a
+		// "not found" on the exact set: c (or another CID sharing its
+		// bloom slot) could be marked and we'd have no record of it.
+		// Fail the whole set closed rather than risk a false "unmarked".
+		s.setErr(err)
+		return err
+	}
+	return nil
+}
+
+func (s *bloomMarkSet) Has(c *cid.Cid) bool {
+	if s.Err() != nil {
+		return true
+	}
+	if !s.filter.Test(c.Hash()) {
+		return false
+	}
+	ok, err := s.store.Has(markSetKey(c))
+	if err != nil {
+		// Can't tell whether c is marked; assume it is rather than let
+		// GC delete a block that may still be pinned.
+		s.setErr(err)
+		return true
+	}
+	return ok
+}
+
+func (s *bloomMarkSet) Visit(c *cid.Cid) bool {
+	if s.Has(c) {
+		return false
+	}
+	// Add's error is recorded on s and surfaced through Err/Has; Visit's
+	// bool return is dag.EnumerateChildren's dedup signal, not a place
+	// to report it.
+	s.Add(c)
+	return true
+}
+
+func (s *bloomMarkSet) Close() error {
+	if closer, ok := s.store.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
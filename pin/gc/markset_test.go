@@ -0,0 +1,157 @@
+package gc
+
+import (
+	"errors"
+	"testing"
+
+	mh "gx/ipfs/QmU9a9NV9RdPNwZQDYd5uKsm6N6WjCi1bYpSKyZ3hUAcCx/go-multihash"
+	cid "gx/ipfs/QmV5gPoRsjN1Gid3LMdNZTyfCtP2DsvqEbMAmz82RmmiGk/go-cid"
+	ds "gx/ipfs/QmZ6nzCLwGLVfRzYLpD7pW6UNuBDKEcA2imJtVpiEX6mSq/go-datastore"
+	dsq "gx/ipfs/QmZ6nzCLwGLVfRzYLpD7pW6UNuBDKEcA2imJtVpiEX6mSq/go-datastore/query"
+)
+
+// TestMarkSetKeyedByMultihash checks that a block marked under one CID
+// version/codec is still recognized as marked when looked up under a
+// different CID wrapping the same underlying multihash — the whole point
+// of keying MarkSet by multihash instead of by the full CID.
+func TestMarkSetKeyedByMultihash(t *testing.T) {
+	h, err := mh.Sum([]byte("same-block-different-cids"), mh.SHA2_256, -1)
+	if err != nil {
+		t.Fatalf("hashing: %s", err)
+	}
+	v0 := cid.NewCidV0(h)
+	v1 := cid.NewCidV1(cid.DagProtobuf, h)
+
+	builders := map[string]MarkSetBuilder{
+		"mem":   DefaultMarkSetBuilder,
+		"bloom": BloomMarkSetBuilder{Store: newFailingDatastore(1 << 20)},
+	}
+	for name, builder := range builders {
+		t.Run(name, func(t *testing.T) {
+			set, err := builder.New(0)
+			if err != nil {
+				t.Fatalf("New: %s", err)
+			}
+			defer set.Close()
+
+			if err := set.Add(v1); err != nil {
+				t.Fatalf("Add: %s", err)
+			}
+			if !set.Has(v0) {
+				t.Errorf("expected block marked via %s (CIDv1) to be Has under %s (CIDv0): same multihash, different CID", v1, v0)
+			}
+		})
+	}
+}
+
+// failingDatastore is a ds.Datastore whose Put and Has calls error once
+// failAfter calls have succeeded, to exercise bloomMarkSet's fail-closed
+// behavior when its backing store misbehaves.
+type failingDatastore struct {
+	failAfter int
+	calls     int
+	data      map[ds.Key]struct{}
+}
+
+func newFailingDatastore(failAfter int) *failingDatastore {
+	return &failingDatastore{failAfter: failAfter, data: make(map[ds.Key]struct{})}
+}
+
+func (d *failingDatastore) shouldFail() bool {
+	d.calls++
+	return d.calls > d.failAfter
+}
+
+func (d *failingDatastore) Put(key ds.Key, value interface{}) error {
+	if d.shouldFail() {
+		return errors.New("simulated datastore failure")
+	}
+	d.data[key] = struct{}{}
+	return nil
+}
+
+func (d *failingDatastore) Get(key ds.Key) (interface{}, error) {
+	if _, ok := d.data[key]; !ok {
+		return nil, ds.ErrNotFound
+	}
+	return struct{}{}, nil
+}
+
+func (d *failingDatastore) Has(key ds.Key) (bool, error) {
+	if d.shouldFail() {
+		return false, errors.New("simulated datastore failure")
+	}
+	_, ok := d.data[key]
+	return ok, nil
+}
+
+func (d *failingDatastore) Delete(key ds.Key) error {
+	delete(d.data, key)
+	return nil
+}
+
+func (d *failingDatastore) Query(q dsq.Query) (dsq.Results, error) {
+	return dsq.ResultsWithEntries(q, nil), nil
+}
+
+// TestBloomMarkSetFailsClosedOnStoreError checks that once the backing
+// store starts failing, Has reports every CID as marked (fail closed)
+// instead of falling back to treating them as unmarked, and that the
+// failure is surfaced through Err so ColoredSet can abort the GC run.
+func TestBloomMarkSetFailsClosedOnStoreError(t *testing.T) {
+	store := newFailingDatastore(0)
+	builder := BloomMarkSetBuilder{Store: store, FalsePositiveRate: 0.01}
+
+	set, err := builder.New(16)
+	if err != nil {
+		t.Fatalf("New: %s", err)
+	}
+	defer set.Close()
+
+	marked := testCid(t, "marked-but-unpersisted")
+	unrelated := testCid(t, "never-marked")
+
+	if err := set.Add(marked); err == nil {
+		t.Fatalf("expected Add to surface the simulated store failure")
+	}
+	if set.Err() == nil {
+		t.Fatalf("expected Err to report the store failure after a failed Add")
+	}
+
+	if !set.Has(marked) {
+		t.Errorf("expected Has to fail closed (true) for a mark that couldn't be persisted")
+	}
+	if !set.Has(unrelated) {
+		t.Errorf("expected Has to fail closed (true) for any CID once the store has failed")
+	}
+}
+
+// TestBloomMarkSetHappyPath checks ordinary marking without any store
+// failures, so the fail-closed test above isn't the only thing exercising
+// this type.
+func TestBloomMarkSetHappyPath(t *testing.T) {
+	store := newFailingDatastore(1 << 20) // never fails within this test
+	builder := BloomMarkSetBuilder{Store: store}
+
+	set, err := builder.New(0)
+	if err != nil {
+		t.Fatalf("New: %s", err)
+	}
+	defer set.Close()
+
+	marked := testCid(t, "marked")
+	unmarked := testCid(t, "unmarked")
+
+	if err := set.Add(marked); err != nil {
+		t.Fatalf("Add: %s", err)
+	}
+	if err := set.Err(); err != nil {
+		t.Fatalf("unexpected Err: %s", err)
+	}
+	if !set.Has(marked) {
+		t.Errorf("expected marked CID to be reported as Has")
+	}
+	if set.Has(unmarked) {
+		t.Errorf("expected unmarked CID to be reported as not Has")
+	}
+}
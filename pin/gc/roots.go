@@ -0,0 +1,100 @@
+package gc
+
+import (
+	"context"
+
+	cid "gx/ipfs/QmV5gPoRsjN1Gid3LMdNZTyfCtP2DsvqEbMAmz82RmmiGk/go-cid"
+)
+
+// RootProvider supplies additional best-effort GC roots: CIDs (and their
+// descendants) that should survive a GC run even though they aren't
+// reachable through the pinner, e.g. unpublished MFS state or a
+// configured keep-alive list. A root a RootProvider returns may not
+// actually exist in the blockstore yet (e.g. mid-write MFS state);
+// ColoredSet already walks best-effort roots with a lenient GetLinks
+// that tolerates dag.ErrNotFound, so a provider doesn't need to guard
+// against that itself.
+type RootProvider interface {
+	Roots(ctx context.Context) ([]*cid.Cid, error)
+}
+
+// StaticRoots adapts an already-resolved slice of root CIDs to a
+// RootProvider, for callers migrating from GC's old bestEffortRoots
+// []*cid.Cid parameter.
+type StaticRoots []*cid.Cid
+
+func (r StaticRoots) Roots(ctx context.Context) ([]*cid.Cid, error) {
+	return []*cid.Cid(r), nil
+}
+
+// resolveRootProviders calls Roots on every provider and flattens the
+// results. A provider's error is non-fatal: it's streamed on out and the
+// remaining providers still run. Unlike the errors ColoredSet streams, it
+// does not abort the sweep. A provider is allowed to return roots
+// alongside a non-nil error (e.g. ConfigKeepAliveRootProvider skipping
+// unparseable entries), so those roots are always kept rather than
+// discarded along with the error.
+func resolveRootProviders(ctx context.Context, providers []RootProvider, out chan<- Result) []*cid.Cid {
+	var roots []*cid.Cid
+	for _, p := range providers {
+		rs, err := p.Roots(ctx)
+		roots = append(roots, rs...)
+		if err != nil {
+			emit(ctx, out, Result{Error: err})
+		}
+	}
+	return roots
+}
+
+// MFSRootGetter is the narrow slice of *mfs.Root's API MFSRootProvider
+// needs. It's expressed as an interface here, rather than importing the
+// mfs package directly, to avoid a dependency cycle between pin/gc and
+// mfs.
+type MFSRootGetter interface {
+	GetValue(ctx context.Context) (*cid.Cid, error)
+}
+
+// MFSRootProvider resolves the current MFS ("files") root to a CID at GC
+// start, so unpublished MFS state is kept even if the caller forgot to
+// enumerate it as a best-effort root. If GetValue fails, the error is
+// streamed on GC's output and that run sweeps without an MFS root.
+type MFSRootProvider struct {
+	Root MFSRootGetter
+}
+
+func (p MFSRootProvider) Roots(ctx context.Context) ([]*cid.Cid, error) {
+	if p.Root == nil {
+		return nil, nil
+	}
+	c, err := p.Root.GetValue(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if c == nil {
+		return nil, nil
+	}
+	return []*cid.Cid{c}, nil
+}
+
+// ConfigKeepAliveRootProvider resolves a configurable list of CID
+// strings (e.g. the repo config's Pinning.KeepAlive) into best-effort GC
+// roots.
+type ConfigKeepAliveRootProvider struct {
+	CIDs []string
+}
+
+func (p ConfigKeepAliveRootProvider) Roots(ctx context.Context) ([]*cid.Cid, error) {
+	roots := make([]*cid.Cid, 0, len(p.CIDs))
+	var firstErr error
+	for _, s := range p.CIDs {
+		c, err := cid.Decode(s)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		roots = append(roots, c)
+	}
+	return roots, firstErr
+}
@@ -0,0 +1,211 @@
+package gc
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	bstore "github.com/ipfs/go-ipfs/blocks/blockstore"
+	dag "github.com/ipfs/go-ipfs/merkledag"
+	pin "github.com/ipfs/go-ipfs/pin"
+
+	cid "gx/ipfs/QmV5gPoRsjN1Gid3LMdNZTyfCtP2DsvqEbMAmz82RmmiGk/go-cid"
+)
+
+// ErrBlockMissing is the error recorded for a pinned descendant whose
+// block is absent from the blockstore.
+var ErrBlockMissing = errors.New("block not found")
+
+// BadPinNode is a pinned root, or one of its descendants, that is missing
+// from the blockstore or that could not be read while verifying it.
+type BadPinNode struct {
+	Cid *cid.Cid
+	Err error
+}
+
+// PinStatus is Verify's per-pin result. Root and Ok/BadNodes are set for
+// a pin that was walked; Err is set instead when the pin itself could
+// not be enumerated (Root is nil in that case).
+type PinStatus struct {
+	Root     *cid.Cid
+	Ok       bool
+	BadNodes []BadPinNode
+	Err      error
+}
+
+// VerifyOptions tunes a Verify run.
+type VerifyOptions struct {
+	// IncludeOk also streams a PinStatus for pins that verified
+	// cleanly, not just the ones with bad nodes.
+	IncludeOk bool
+
+	// Concurrency is the number of pins verified in parallel. 1 (the
+	// default) verifies pins one at a time.
+	Concurrency int
+}
+
+// DefaultVerifyOptions only streams failing pins and verifies them one
+// at a time.
+var DefaultVerifyOptions = VerifyOptions{
+	IncludeOk:   false,
+	Concurrency: 1,
+}
+
+// Verify runs VerifyWithOptions with DefaultVerifyOptions.
+func Verify(ctx context.Context, bs bstore.GCBlockstore, ls dag.LinkService, pn pin.Pinner) <-chan PinStatus {
+	return VerifyWithOptions(ctx, bs, ls, pn, DefaultVerifyOptions)
+}
+
+// VerifyWithOptions walks every recursive pin's DAG, using the same
+// offline link service ColoredSet uses for marking, and reports per root
+// pin whether every reachable block is present in bs. Verification
+// results are memoized per CID across pins (see verifyState), so a
+// shared subgraph that has already verified clean is not fetched again.
+// A shared subgraph with bad nodes beneath it is walked again for each
+// pin, down to its memoized bad nodes.
+func VerifyWithOptions(ctx context.Context, bs bstore.GCBlockstore, ls dag.LinkService, pn pin.Pinner, opts VerifyOptions) <-chan PinStatus {
+	ls = ls.GetOfflineLinkService()
+
+	concurrency := opts.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	roots := recursiveKeysChan(pn)
+	vs := newVerifyState()
+	out := make(chan PinStatus)
+
+	go func() {
+		defer close(out)
+
+		var wg sync.WaitGroup
+		wg.Add(concurrency)
+		for i := 0; i < concurrency; i++ {
+			go func() {
+				defer wg.Done()
+				for pc := range roots {
+					if pc.Err != nil {
+						emitStatus(ctx, out, PinStatus{Err: pc.Err})
+						continue
+					}
+
+					bad := verifyPinnedDAG(ctx, bs, ls, vs, pc.C)
+					ok := len(bad) == 0
+					if ok && !opts.IncludeOk {
+						continue
+					}
+					if !emitStatus(ctx, out, PinStatus{Root: pc.C, Ok: ok, BadNodes: bad}) {
+						return
+					}
+				}
+			}()
+		}
+		wg.Wait()
+	}()
+
+	return out
+}
+
+func emitStatus(ctx context.Context, out chan<- PinStatus, s PinStatus) bool {
+	select {
+	case out <- s:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// verifyState memoizes per-CID verification results across pins: once a
+// CID (and everything beneath it) is known good or known bad, later pins
+// that share that subgraph don't re-fetch it.
+type verifyState struct {
+	mu   sync.Mutex
+	good map[string]bool
+	bad  map[string]error
+}
+
+func newVerifyState() *verifyState {
+	return &verifyState{
+		good: make(map[string]bool),
+		bad:  make(map[string]error),
+	}
+}
+
+func (vs *verifyState) isGood(c *cid.Cid) bool {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+	return vs.good[c.KeyString()]
+}
+
+func (vs *verifyState) markGood(c *cid.Cid) {
+	vs.mu.Lock()
+	vs.good[c.KeyString()] = true
+	vs.mu.Unlock()
+}
+
+func (vs *verifyState) badErr(c *cid.Cid) (error, bool) {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+	err, ok := vs.bad[c.KeyString()]
+	return err, ok
+}
+
+func (vs *verifyState) markBad(c *cid.Cid, err error) {
+	vs.mu.Lock()
+	vs.bad[c.KeyString()] = err
+	vs.mu.Unlock()
+}
+
+// verifyPinnedDAG walks root and its descendants, checking that each one
+// is present in bs and that its links can be read. It returns every bad
+// node found (root included), consulting and updating vs so repeated
+// calls for different roots skip a shared subgraph that already verified
+// clean.
+func verifyPinnedDAG(ctx context.Context, bs bstore.GCBlockstore, ls dag.LinkService, vs *verifyState, root *cid.Cid) []BadPinNode {
+	var bad []BadPinNode
+
+	var walk func(c *cid.Cid)
+	walk = func(c *cid.Cid) {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+
+		if vs.isGood(c) {
+			return
+		}
+		if err, ok := vs.badErr(c); ok {
+			bad = append(bad, BadPinNode{Cid: c, Err: err})
+			return
+		}
+
+		has, err := bs.Has(c)
+		if err == nil && !has {
+			err = ErrBlockMissing
+		}
+		if err != nil {
+			vs.markBad(c, err)
+			bad = append(bad, BadPinNode{Cid: c, Err: err})
+			return
+		}
+
+		links, err := ls.GetLinks(ctx, c)
+		if err != nil {
+			vs.markBad(c, err)
+			bad = append(bad, BadPinNode{Cid: c, Err: err})
+			return
+		}
+
+		before := len(bad)
+		for _, l := range links {
+			walk(l.Cid)
+		}
+		if len(bad) == before {
+			vs.markGood(c)
+		}
+	}
+
+	walk(root)
+	return bad
+}